@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// HealthCheck describes the Docker HEALTHCHECK that should be wired into a
+// managed container's Config.Healthcheck. When set, the manager treats a
+// container reported as "unhealthy" the same way it treats a crashed one.
+type HealthCheck struct {
+	Test        []string
+	Interval    time.Duration
+	Timeout     time.Duration
+	StartPeriod time.Duration
+	Retries     int
+
+	// HealthyWindow is how long a container must stay healthy before the
+	// manager resets its restart backoff back to the initial delay. Zero
+	// means use the manager's default.
+	HealthyWindow time.Duration
+}
+
+// Container is the desired definition of a managed container.
+type Container struct {
+	Image   string
+	Command []string
+	Env     []string
+	Version string
+
+	HealthCheck *HealthCheck
+
+	// StopTimeout is how long, in seconds, Docker waits after StopSignal
+	// before killing the container. Nil uses Docker's default.
+	StopTimeout *int
+	// StopSignal overrides the signal used to stop the container (e.g.
+	// "SIGTERM", "SIGQUIT"). Empty uses the image's default.
+	StopSignal string
+
+	// PullPolicy controls when the image is pulled before create, instead
+	// of only ever relying on whatever is already present locally.
+	PullPolicy PullPolicy
+	// AuthConfig authenticates the pull against a private registry. Nil
+	// pulls anonymously.
+	AuthConfig *registry.AuthConfig
+}
+
+func (c *Container) containerConfig(name string) *container.Config {
+	cfg := &container.Config{
+		Image: c.Image,
+		Cmd:   c.Command,
+		Env:   c.Env,
+		Labels: map[string]string{
+			containerVersionKey: c.Version,
+		},
+		StopSignal:  c.StopSignal,
+		StopTimeout: c.StopTimeout,
+	}
+	if c.HealthCheck != nil {
+		cfg.Healthcheck = &container.HealthConfig{
+			Test:        c.HealthCheck.Test,
+			Interval:    c.HealthCheck.Interval,
+			Timeout:     c.HealthCheck.Timeout,
+			StartPeriod: c.HealthCheck.StartPeriod,
+			Retries:     c.HealthCheck.Retries,
+		}
+	}
+	return cfg
+}
+
+func (c *Container) hostConfig() *container.HostConfig {
+	return &container.HostConfig{}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+)
+
+// PullPolicy controls when ensureImage pulls an image before a container is
+// created, instead of only ever relying on whatever is already present
+// locally.
+type PullPolicy int
+
+const (
+	// PullDefault only pulls when the image is missing locally.
+	PullDefault PullPolicy = iota
+	// PullAlways pulls before every create, even if the image is already
+	// present locally.
+	PullAlways
+	// PullIfNewer pulls exactly as PullAlways does. Under every policy,
+	// ensureImage treats a changed resolved digest as a reload trigger even
+	// when Version is unchanged.
+	PullIfNewer
+)
+
+// imageRefs reference-counts which managers are using which image, so the
+// manager that tears down the last container using an image can garbage
+// collect it.
+var imageRefs = struct {
+	mu   sync.Mutex
+	refs map[string]int
+}{refs: make(map[string]int)}
+
+func acquireImageRef(image string) {
+	imageRefs.mu.Lock()
+	defer imageRefs.mu.Unlock()
+	imageRefs.refs[image]++
+}
+
+// releaseImageRef drops a manager's reference to image and, if it was the
+// last one, removes the image. errdefs.IsConflict (the image is still in
+// use by something this process doesn't know about) is expected and simply
+// skipped rather than logged as a failure.
+func releaseImageRef(ctx context.Context, image string) {
+	imageRefs.mu.Lock()
+	imageRefs.refs[image]--
+	last := imageRefs.refs[image] <= 0
+	if last {
+		delete(imageRefs.refs, image)
+	}
+	imageRefs.mu.Unlock()
+	if !last {
+		return
+	}
+	if _, err := cli.ImageRemove(ctx, image, types.ImageRemoveOptions{}); err != nil {
+		if errdefs.IsConflict(err) {
+			log.Println("image gc:", image, "still in use, skipping")
+			return
+		}
+		log.Println("image gc: cannot remove", image+":", err.Error())
+	}
+}
+
+// ensureImage makes sure the definition's image is present locally, pulling
+// it when it's missing or when PullPolicy requires a fresh pull, and
+// reports whether the resolved digest changed since the last time this
+// manager checked.
+func (m *Manager) ensureImage(ctx context.Context) (digestChanged bool, err error) {
+	image := m.definition.Image
+	_, raw, inspectErr := cli.ImageInspectWithRaw(ctx, image)
+	missing := errdefs.IsNotFound(inspectErr)
+	if missing || m.definition.PullPolicy == PullAlways || m.definition.PullPolicy == PullIfNewer {
+		if err := m.pullImage(ctx, image); err != nil {
+			return false, err
+		}
+		_, raw, inspectErr = cli.ImageInspectWithRaw(ctx, image)
+	}
+	if inspectErr != nil {
+		return false, inspectErr
+	}
+	digest := imageDigest(raw)
+	digestChanged = m.lastImageDigest != "" && m.lastImageDigest != digest
+	m.lastImageDigest = digest
+	return digestChanged, nil
+}
+
+func (m *Manager) pullImage(ctx context.Context, image string) error {
+	var authEncoded string
+	if m.definition.AuthConfig != nil {
+		b, err := json.Marshal(m.definition.AuthConfig)
+		if err != nil {
+			return err
+		}
+		authEncoded = base64.URLEncoding.EncodeToString(b)
+	}
+	m.log.Println("pulling image", image)
+	rc, err := cli.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: authEncoded})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
+
+// imageDigest pulls the image ID out of the raw ImageInspectWithRaw
+// response, used as a stand-in for the image's content digest.
+func imageDigest(raw []byte) string {
+	var summary struct {
+		ID string `json:"Id"`
+	}
+	if err := json.Unmarshal(raw, &summary); err != nil {
+		return ""
+	}
+	return summary.ID
+}
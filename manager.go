@@ -8,20 +8,62 @@ import (
 	"time"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
 )
 
 const containerVersionKey = "com.cenkalti.container-manager.container-version"
 
+const (
+	// initialRestartBackoff is the delay between the first and second
+	// restart attempts; the first restart after a container is reported
+	// unhealthy happens right away.
+	initialRestartBackoff = time.Second
+	// maxRestartBackoff caps the exponential backoff between restarts.
+	maxRestartBackoff = 30 * time.Second
+	// defaultHealthyWindow is how long a container must stay healthy before
+	// the restart backoff resets, when the definition doesn't specify one.
+	defaultHealthyWindow = time.Minute
+	// retryDelay is how soon a transient or conflicting failure is retried,
+	// rather than waiting for the next regular poll.
+	retryDelay = 5 * time.Second
+)
+
+// ReloadOutcome classifies how a doReload call finished, so callers and
+// tests can tell a clean pass from a failure worth treating specially.
+type ReloadOutcome int
+
+const (
+	// ReloadOK means doReload reached a steady state (or failed in a way
+	// that will simply be retried on the next regular poll).
+	ReloadOK ReloadOutcome = iota
+	// ReloadConflict means a remove raced with something else holding the
+	// container (errdefs.IsConflict) and should be retried sooner.
+	ReloadConflict
+	// ReloadTransient means a system error (errdefs.IsSystem) was hit and
+	// should be retried sooner, since it's likely to clear on its own.
+	ReloadTransient
+	// ReloadTerminal means an unauthorized/forbidden error (e.g. a private
+	// image it can't pull) was hit and reconciliation has stopped.
+	ReloadTerminal
+)
+
 type Manager struct {
 	name       string
 	definition *Container
 	log        *log.Logger
-	closeC     chan struct{}
 	closedC    chan struct{}
 	closeOnce  sync.Once
 	closed     bool
-	reloadC    chan struct{}
+
+	restartBackoff time.Duration
+	nextRestartAt  time.Time
+	healthySince   time.Time
+
+	lastImageDigest string
+	heldImage       string
+
+	sm stateMachine
 }
 
 func Manage(name string, c *Container) *Manager {
@@ -29,126 +71,311 @@ func Manage(name string, c *Container) *Manager {
 		name:       name,
 		definition: c,
 		log:        log.New(os.Stderr, "["+name+"] ", log.LstdFlags),
-		closeC:     make(chan struct{}),
 		closedC:    make(chan struct{}),
-		reloadC:    make(chan struct{}, 1),
 	}
-	m.reloadC <- struct{}{}
-	go m.run()
+	m.transition(StateConfigured, nil)
+	defaultReconciler.register(m)
 	return m
 }
 
-func (m *Manager) run() {
-	defer close(m.closedC)
-	for {
-		if m.closed {
-			return
-		}
-		select {
-		case <-m.closeC:
-			return
-		case <-time.After(time.Minute):
-			m.doReload()
-		case <-m.reloadC:
-			m.doReload()
-		}
+// handleReload runs doReload and acts on its outcome: retryable failures get
+// a sooner retry instead of waiting for the next regular poll, and terminal
+// failures stop reconciliation for this manager altogether.
+func (m *Manager) handleReload() {
+	switch m.doReload() {
+	case ReloadConflict, ReloadTransient:
+		time.AfterFunc(retryDelay, m.Reload)
+	case ReloadTerminal:
+		m.log.Println("terminal failure, halting reconciliation")
+		m.doClose()
 	}
 }
 
-func (m *Manager) doReload() {
+func (m *Manager) doReload() ReloadOutcome {
 	ctx := context.Background()
 	con, err := cli.ContainerInspect(ctx, m.name)
-	if client.IsErrNotFound(err) {
+	if errdefs.IsNotFound(err) {
 		m.log.Println("container not found, creating new container")
+		if _, err := m.ensureImage(ctx); err != nil {
+			return m.imageFailure(err)
+		}
 		resp, err := cli.ContainerCreate(ctx, m.definition.containerConfig(m.name), m.definition.hostConfig(), nil, m.name)
 		if err != nil {
-			m.log.Println("cannot create container:", err.Error())
-			return
+			return m.createFailure(err)
 		}
+		acquireImageRef(m.definition.Image)
+		m.heldImage = m.definition.Image
+		m.transition(StateCreated, nil)
 		m.log.Println("starting new container")
 		err = cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
 		if err != nil {
 			m.log.Println("cannot start container:", err.Error())
-			return
+			m.transition(StateFailed, err)
+			return ReloadOK
 		}
-		return
+		m.transition(StateRunning, nil)
+		return ReloadOK
 	}
 	if err != nil {
 		m.log.Println("cannot inspect container:", err.Error())
-		return
+		if errdefs.IsSystem(err) {
+			return ReloadTransient
+		}
+		return ReloadOK
+	}
+	if m.heldImage == "" {
+		// Adopting a container we didn't create ourselves (e.g. the process
+		// just (re)started): count its image ref now so later teardown or
+		// recreation doesn't release a reference that was never acquired.
+		acquireImageRef(con.Config.Image)
+		m.heldImage = con.Config.Image
 	}
 	newDef := getContainerDefinion(m.name)
 	if newDef == nil {
 		m.log.Println("container definition not found, stopping container")
-		err := cli.ContainerStop(ctx, m.name, nil)
+		m.transition(StateRemoving, nil)
+		err := m.stopContainer(ctx, m.name)
 		if err != nil {
 			m.log.Println("cannot stop container:", err.Error())
-			return
+			return ReloadOK
 		}
 		m.log.Println("removing stale container")
 		err = cli.ContainerRemove(ctx, m.name, types.ContainerRemoveOptions{Force: true})
 		if err != nil {
-			m.log.Println("cannot remove container:", err.Error())
-			return
+			return m.removeFailure(err)
 		}
+		releaseImageRef(ctx, m.heldImage)
+		m.heldImage = ""
 		mu.Lock()
 		delete(managers, m.name)
 		mu.Unlock()
+		m.transition(StateUnknown, nil)
 		m.doClose()
-		return
+		return ReloadOK
 	}
-	if con.Config.Labels[containerVersionKey] == newDef.Version {
+	digestChanged, err := m.ensureImage(ctx)
+	if err != nil {
+		return m.imageFailure(err)
+	}
+	if con.Config.Labels[containerVersionKey] == newDef.Version && !digestChanged {
 		if !con.State.Running {
 			m.log.Println("container not running, starting container")
+			m.transition(StateStopped, nil)
 			err = cli.ContainerStart(ctx, con.ID, types.ContainerStartOptions{})
 			if err != nil {
 				m.log.Println("cannot start container:", err.Error())
-				return
+				m.transition(StateFailed, err)
+				return ReloadOK
 			}
+			m.transition(StateRunning, nil)
+			return ReloadOK
 		}
-		return
+		m.transition(StateRunning, nil)
+		m.checkHealth(ctx, con)
+		return ReloadOK
 	}
-	m.log.Println("container definition changed, reloading")
+	if digestChanged {
+		m.log.Println("image digest changed, reloading")
+	} else {
+		m.log.Println("container definition changed, reloading")
+	}
+	oldImage := m.heldImage
+	sameImage := oldImage == newDef.Image
+	m.transition(StateRemoving, nil)
 	if con.State.Running {
 		m.log.Println("stopping old container")
-		err := cli.ContainerStop(ctx, m.name, nil)
+		err := m.stopContainer(ctx, m.name)
 		if err != nil {
 			m.log.Println("cannot stop container:", err.Error())
-			return
+			return ReloadOK
 		}
 	}
 	m.log.Println("removing old container")
 	err = cli.ContainerRemove(ctx, con.ID, types.ContainerRemoveOptions{Force: true})
 	if err != nil {
-		m.log.Println("cannot remove container:", err.Error())
-		return
+		return m.removeFailure(err)
+	}
+	// Only release the old image once the new container no longer needs it:
+	// if the new definition keeps the same image, releasing it here (before
+	// the new container is created below) could drop its last reference and
+	// have it garbage collected out from under the create that follows.
+	if !sameImage {
+		releaseImageRef(ctx, oldImage)
 	}
 	m.definition = newDef
+	m.transition(StateConfigured, nil)
 	m.log.Println("creating new container")
 	resp, err := cli.ContainerCreate(ctx, m.definition.containerConfig(m.name), m.definition.hostConfig(), nil, m.name)
 	if err != nil {
-		m.log.Println("cannot create container:", err.Error())
-		return
+		return m.createFailure(err)
 	}
+	if !sameImage {
+		acquireImageRef(m.definition.Image)
+	}
+	m.heldImage = m.definition.Image
+	m.transition(StateCreated, nil)
 	m.log.Println("starting new container")
 	err = cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
 	if err != nil {
 		m.log.Println("cannot start container:", err.Error())
+		m.transition(StateFailed, err)
+		return ReloadOK
+	}
+	m.transition(StateRunning, nil)
+	return ReloadOK
+}
+
+// createFailure classifies a ContainerCreate error: unauthorized/forbidden
+// (e.g. a private image pull) is terminal, a system error is retried sooner,
+// anything else is logged and left for the next regular poll.
+func (m *Manager) createFailure(err error) ReloadOutcome {
+	if errdefs.IsUnauthorized(err) || errdefs.IsForbidden(err) {
+		m.log.Println("cannot create container, not authorized:", err.Error())
+		m.transition(StateFailed, err)
+		return ReloadTerminal
+	}
+	m.log.Println("cannot create container:", err.Error())
+	if errdefs.IsSystem(err) {
+		return ReloadTransient
+	}
+	return ReloadOK
+}
+
+// imageFailure classifies an ensureImage error: unauthorized/forbidden (a
+// private image this manager can't pull) is terminal, same as an equivalent
+// ContainerCreate failure, since retrying a pull that will never authorize
+// just logs the same error forever. Anything else is logged and left for
+// the next regular poll.
+func (m *Manager) imageFailure(err error) ReloadOutcome {
+	if errdefs.IsUnauthorized(err) || errdefs.IsForbidden(err) {
+		m.log.Println("cannot pull image, not authorized:", err.Error())
+		m.transition(StateFailed, err)
+		return ReloadTerminal
+	}
+	m.log.Println("cannot ensure image:", err.Error())
+	return ReloadOK
+}
+
+// removeFailure classifies a ContainerRemove error: a conflict (still
+// running, still referenced) is retried sooner rather than dropped.
+func (m *Manager) removeFailure(err error) ReloadOutcome {
+	if errdefs.IsConflict(err) {
+		m.log.Println("container removal conflicted, will retry:", err.Error())
+		return ReloadConflict
+	}
+	m.log.Println("cannot remove container:", err.Error())
+	m.transition(StateFailed, err)
+	return ReloadOK
+}
+
+// stopContainer asks the container to exit using the definition's configured
+// StopSignal and StopTimeout. Docker itself escalates to SIGKILL once the
+// timeout elapses, but if the container is somehow still running once
+// ContainerStop returns, this logs a distinct warning and force-kills it
+// rather than leaving the caller to remove a container that never stopped.
+// When the container has exited by the time ContainerStop returns, its exit
+// code and OOMKilled flag are logged so operators can tell a clean shutdown
+// from an OOM kill; on the SIGKILL path they are not logged.
+func (m *Manager) stopContainer(ctx context.Context, id string) error {
+	opts := container.StopOptions{
+		Signal:  m.definition.StopSignal,
+		Timeout: m.definition.StopTimeout,
+	}
+	if err := cli.ContainerStop(ctx, id, opts); err != nil {
+		return err
+	}
+	con, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return err
+	}
+	if con.State != nil && con.State.Running {
+		m.log.Println("container did not exit within stop timeout, escalating to SIGKILL")
+		return cli.ContainerKill(ctx, id, "SIGKILL")
+	}
+	m.logExit(con)
+	return nil
+}
+
+// logExit surfaces a container's exit code and OOMKilled flag so operators
+// can distinguish a clean shutdown from an OOM kill from the manager's log,
+// instead of reaching for `docker inspect`. They are written to the log only,
+// not sent on the Subscribe event stream.
+func (m *Manager) logExit(con types.ContainerJSON) {
+	if con.State == nil {
+		return
+	}
+	if con.State.OOMKilled {
+		m.log.Printf("container was OOM-killed (exit code %d)", con.State.ExitCode)
+		return
+	}
+	m.log.Printf("container exited with code %d", con.State.ExitCode)
+}
+
+// checkHealth inspects a running container's health status and, if it has
+// been reported unhealthy, restarts it with an exponential backoff between
+// attempts. The backoff resets once the container has stayed healthy for
+// the definition's HealthyWindow (or defaultHealthyWindow if unset).
+func (m *Manager) checkHealth(ctx context.Context, con types.ContainerJSON) {
+	if con.State == nil || con.State.Health == nil {
 		return
 	}
+	if con.State.Health.Status != "unhealthy" {
+		m.noteHealthy()
+		return
+	}
+	m.healthySince = time.Time{}
+	if time.Now().Before(m.nextRestartAt) {
+		return
+	}
+	m.log.Println("container unhealthy, restarting")
+	if err := m.stopContainer(ctx, m.name); err != nil {
+		m.log.Println("cannot stop unhealthy container:", err.Error())
+		return
+	}
+	if err := cli.ContainerStart(ctx, con.ID, types.ContainerStartOptions{}); err != nil {
+		m.log.Println("cannot restart unhealthy container:", err.Error())
+		return
+	}
+	if m.restartBackoff == 0 {
+		m.restartBackoff = initialRestartBackoff
+	} else {
+		m.restartBackoff *= 2
+		if m.restartBackoff > maxRestartBackoff {
+			m.restartBackoff = maxRestartBackoff
+		}
+	}
+	m.nextRestartAt = time.Now().Add(m.restartBackoff)
+}
+
+// noteHealthy tracks how long a container has been continuously healthy and
+// resets the restart backoff once it has cleared the healthy window.
+func (m *Manager) noteHealthy() {
+	if m.healthySince.IsZero() {
+		m.healthySince = time.Now()
+		return
+	}
+	window := defaultHealthyWindow
+	if m.definition.HealthCheck != nil && m.definition.HealthCheck.HealthyWindow > 0 {
+		window = m.definition.HealthCheck.HealthyWindow
+	}
+	if time.Since(m.healthySince) >= window {
+		m.restartBackoff = 0
+		m.nextRestartAt = time.Time{}
+	}
 }
 
 func (m *Manager) doClose() {
 	m.closeOnce.Do(func() {
 		m.closed = true
-		close(m.closeC)
+		defaultReconciler.unregister(m.name)
+		close(m.closedC)
 	})
 }
 
-// Reload the definition from config and make necessary changes to container
+// Reload schedules the definition to be re-read and reconciled against the
+// running container. Enqueueing is non-blocking: if this manager already has
+// a reconciliation queued or in progress, one more pass is run after it
+// rather than a second one concurrently.
 func (m *Manager) Reload() {
-	select {
-	case m.reloadC <- struct{}{}:
-	default:
-	}
+	defaultReconciler.enqueue(m.name)
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/docker/docker/errdefs"
+)
+
+func newTestManager() *Manager {
+	return &Manager{
+		name: "test",
+		log:  log.New(io.Discard, "", 0),
+	}
+}
+
+func TestCreateFailureClassification(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want ReloadOutcome
+	}{
+		{"unauthorized is terminal", errdefs.Unauthorized(errors.New("nope")), ReloadTerminal},
+		{"forbidden is terminal", errdefs.Forbidden(errors.New("nope")), ReloadTerminal},
+		{"system error is transient", errdefs.System(errors.New("boom")), ReloadTransient},
+		{"anything else is left for the next poll", errors.New("boom"), ReloadOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestManager()
+			if got := m.createFailure(c.err); got != c.want {
+				t.Fatalf("createFailure(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestImageFailureClassification(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want ReloadOutcome
+	}{
+		{"unauthorized is terminal", errdefs.Unauthorized(errors.New("nope")), ReloadTerminal},
+		{"forbidden is terminal", errdefs.Forbidden(errors.New("nope")), ReloadTerminal},
+		{"anything else is left for the next poll", errors.New("boom"), ReloadOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestManager()
+			if got := m.imageFailure(c.err); got != c.want {
+				t.Fatalf("imageFailure(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRemoveFailureClassification(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want ReloadOutcome
+	}{
+		{"conflict is retried", errdefs.Conflict(errors.New("still running")), ReloadConflict},
+		{"anything else is left for the next poll", errors.New("boom"), ReloadOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestManager()
+			if got := m.removeFailure(c.err); got != c.want {
+				t.Fatalf("removeFailure(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
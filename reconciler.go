@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	// reconcileInterval is how often the reconciler lists managed
+	// containers to catch anything the events stream missed.
+	reconcileInterval = time.Minute
+	// reconcilerWorkers bounds how many reconciliations run at once,
+	// regardless of how many containers are managed.
+	reconcilerWorkers = 8
+)
+
+// Reconciler is the single subsystem that drives reconciliation for every
+// Manager. It replaces the old one-goroutine-plus-ticker-per-manager design,
+// which cost O(N) goroutines for N managed containers. Instead it subscribes
+// to the Docker events stream so definition-relevant changes trigger an
+// immediate reload, and once per interval it dispatches a reconciliation for
+// every managed container to catch anything the events stream missed,
+// bounded to reconcilerWorkers at a time.
+type Reconciler struct {
+	mu       sync.Mutex
+	managers map[string]*Manager
+	// running/dirty together coalesce and serialize per-name work: a name
+	// in running has a goroutine reconciling it right now; a name in dirty
+	// was enqueued again while that goroutine was still running, so it
+	// loops around for one more pass instead of a second goroutine
+	// starting concurrently.
+	running map[string]bool
+	dirty   map[string]bool
+	sem     chan struct{}
+
+	startOnce sync.Once
+}
+
+// defaultReconciler is shared by every Manager. Manage registers with it
+// instead of spinning up a dedicated goroutine, and Reload enqueues into its
+// shared work queue.
+var defaultReconciler = &Reconciler{
+	managers: make(map[string]*Manager),
+	running:  make(map[string]bool),
+	dirty:    make(map[string]bool),
+	sem:      make(chan struct{}, reconcilerWorkers),
+}
+
+// register adds m to the reconciler, starting its background loops on the
+// first call, and schedules an immediate reconciliation.
+func (r *Reconciler) register(m *Manager) {
+	r.mu.Lock()
+	r.managers[m.name] = m
+	r.mu.Unlock()
+
+	r.startOnce.Do(r.start)
+	r.enqueue(m.name)
+}
+
+// unregister removes name so it no longer receives event- or poll-driven
+// reconciliation.
+func (r *Reconciler) unregister(name string) {
+	r.mu.Lock()
+	delete(r.managers, name)
+	r.mu.Unlock()
+}
+
+// enqueue schedules name for reconciliation. If name is already being
+// reconciled, this just marks it dirty so that run does one more pass once
+// it finishes, rather than starting a second, concurrent reconciliation of
+// the same manager.
+func (r *Reconciler) enqueue(name string) {
+	r.mu.Lock()
+	if r.running[name] {
+		r.dirty[name] = true
+		r.mu.Unlock()
+		return
+	}
+	r.running[name] = true
+	r.mu.Unlock()
+
+	go r.reconcileUntilClean(name)
+}
+
+// reconcileUntilClean reconciles name, then immediately does so again if it
+// was marked dirty while that reconciliation was in flight, repeating until
+// a pass leaves it clean. This keeps a single manager's reconciliations
+// strictly serialized no matter how many times it's enqueued concurrently
+// (events, polling, and explicit Reload calls can all race to enqueue it).
+func (r *Reconciler) reconcileUntilClean(name string) {
+	r.sem <- struct{}{}
+	defer func() { <-r.sem }()
+
+	for {
+		r.mu.Lock()
+		m := r.managers[name]
+		r.mu.Unlock()
+		if m != nil {
+			m.handleReload()
+		}
+
+		r.mu.Lock()
+		if !r.dirty[name] {
+			r.running[name] = false
+			r.mu.Unlock()
+			return
+		}
+		delete(r.dirty, name)
+		r.mu.Unlock()
+	}
+}
+
+func (r *Reconciler) start() {
+	go r.watchEvents()
+	go r.pollLoop()
+}
+
+// watchEvents subscribes to the Docker events stream so a managed
+// container's definition-relevant state changes (dying, OOM-killed, health
+// status flipping) trigger a reconciliation immediately instead of waiting
+// for the next poll.
+func (r *Reconciler) watchEvents() {
+	ctx := context.Background()
+	f := filters.NewArgs(filters.Arg("type", "container"))
+	msgC, errC := cli.Events(ctx, types.EventsOptions{Filters: f})
+	for {
+		select {
+		case msg, ok := <-msgC:
+			if !ok {
+				return
+			}
+			name := msg.Actor.Attributes["name"]
+			r.mu.Lock()
+			_, managed := r.managers[name]
+			r.mu.Unlock()
+			if managed {
+				r.enqueue(name)
+			}
+		case err, ok := <-errC:
+			if !ok {
+				return
+			}
+			log.Println("reconciler: events stream error, falling back to polling:", err.Error())
+			return
+		}
+	}
+}
+
+// pollLoop dispatches a reconciliation for every managed container once per
+// interval, instead of each manager polling on its own timer.
+//
+// An earlier version of this tried to prime a shared cache from a single
+// batched ContainerList call so doReload could skip its own ContainerInspect.
+// That cache went stale between sweeps: an event-driven reconcile running
+// after a container was created but before the next sweep would see it
+// listed as absent and fabricate a not-found, sending doReload back into the
+// create branch and conflicting with the container it just made. Each
+// manager's own ContainerInspect is the only source that's never stale.
+func (r *Reconciler) pollLoop() {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.enqueueAll()
+	}
+}
+
+func (r *Reconciler) enqueueAll() {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.managers))
+	for name := range r.managers {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	for _, name := range names {
+		r.enqueue(name)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ManagerState models the lifecycle of a managed container, following the
+// naming used by libpod's define.ContainerState so the states are familiar
+// to anyone who has operated Podman.
+type ManagerState int
+
+const (
+	StateUnknown ManagerState = iota
+	StateConfigured
+	StateCreated
+	StateRunning
+	StateStopped
+	StateExited
+	StateRemoving
+	StateFailed
+)
+
+func (s ManagerState) String() string {
+	switch s {
+	case StateConfigured:
+		return "configured"
+	case StateCreated:
+		return "created"
+	case StateRunning:
+		return "running"
+	case StateStopped:
+		return "stopped"
+	case StateExited:
+		return "exited"
+	case StateRemoving:
+		return "removing"
+	case StateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// legalTransitions enumerates which states a manager may move to from a
+// given state. A transition not listed here (and not a no-op) is a bug in
+// the manager and panics rather than silently corrupting the state.
+//
+// Configured can jump straight to Running, Stopped, or Removing: a Manager
+// moves to Configured as soon as it's constructed, and its first reconcile
+// may discover an already-existing container (e.g. after a process
+// restart) in any of those states, rather than one the Manager created
+// itself and therefore knows to be Created first.
+var legalTransitions = map[ManagerState][]ManagerState{
+	StateUnknown:    {StateConfigured, StateFailed},
+	StateConfigured: {StateCreated, StateRunning, StateStopped, StateRemoving, StateFailed},
+	StateCreated:    {StateRunning, StateRemoving, StateFailed},
+	StateRunning:    {StateStopped, StateExited, StateRemoving, StateFailed},
+	StateStopped:    {StateRunning, StateRemoving, StateFailed},
+	StateExited:     {StateRunning, StateRemoving, StateFailed},
+	StateRemoving:   {StateUnknown, StateConfigured, StateFailed},
+	// Failed is reached from a ContainerStart failure, which leaves a
+	// created-but-stopped container behind, so the next reconcile may find
+	// it running (started after all), stopped, or exited, not just back at
+	// Configured or torn down via Removing.
+	StateFailed: {StateConfigured, StateCreated, StateRunning, StateStopped, StateExited, StateRemoving},
+}
+
+// StateEvent records a single state transition of a Manager.
+type StateEvent struct {
+	At       time.Time
+	Previous ManagerState
+	Current  ManagerState
+	Err      error
+}
+
+// stateMachine tracks a Manager's current lifecycle state and fans out every
+// transition to subscribers, so reconciliation can be observed deterministically
+// instead of scraped from logs.
+type stateMachine struct {
+	mu          sync.Mutex
+	state       ManagerState
+	subscribers []chan StateEvent
+}
+
+// State returns the manager's current lifecycle state.
+func (m *Manager) State() ManagerState {
+	m.sm.mu.Lock()
+	defer m.sm.mu.Unlock()
+	return m.sm.state
+}
+
+// Subscribe returns a channel that receives every state transition this
+// manager makes from now on. The channel is buffered; a slow reader misses
+// events rather than blocking reconciliation.
+func (m *Manager) Subscribe() <-chan StateEvent {
+	m.sm.mu.Lock()
+	defer m.sm.mu.Unlock()
+	c := make(chan StateEvent, 8)
+	m.sm.subscribers = append(m.sm.subscribers, c)
+	return c
+}
+
+// transition moves the manager to next, enforcing that it's a legal move
+// from the current state, and notifies subscribers.
+func (m *Manager) transition(next ManagerState, cause error) {
+	m.sm.mu.Lock()
+	prev := m.sm.state
+	if prev != next && !isLegalTransition(prev, next) {
+		m.sm.mu.Unlock()
+		panic(fmt.Sprintf("manager %q: illegal state transition %s -> %s", m.name, prev, next))
+	}
+	m.sm.state = next
+	event := StateEvent{At: time.Now(), Previous: prev, Current: next, Err: cause}
+	subs := m.sm.subscribers
+	m.sm.mu.Unlock()
+
+	for _, c := range subs {
+		select {
+		case c <- event:
+		default:
+		}
+	}
+}
+
+func isLegalTransition(from, to ManagerState) bool {
+	for _, s := range legalTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
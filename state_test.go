@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestManagerAdoptsExistingContainerWithoutPanic(t *testing.T) {
+	m := &Manager{name: "test"}
+	m.transition(StateConfigured, nil)
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("adopting an already-running container panicked: %v", r)
+		}
+	}()
+	m.transition(StateRunning, nil)
+}
+
+func TestManagerIllegalTransitionPanics(t *testing.T) {
+	m := &Manager{name: "test"}
+	m.transition(StateConfigured, nil)
+	m.transition(StateCreated, nil)
+	m.transition(StateRunning, nil)
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected Running -> Configured to panic as an illegal transition")
+		}
+	}()
+	m.transition(StateConfigured, nil)
+}
+
+func TestManagerStateReflectsLatestTransition(t *testing.T) {
+	m := &Manager{name: "test"}
+	m.transition(StateConfigured, nil)
+	m.transition(StateCreated, nil)
+	m.transition(StateRunning, nil)
+
+	if got := m.State(); got != StateRunning {
+		t.Fatalf("State() = %v, want %v", got, StateRunning)
+	}
+}
+
+func TestManagerFailedRecoversOnNextReconcile(t *testing.T) {
+	cases := []ManagerState{StateCreated, StateRunning, StateStopped, StateExited}
+	for _, next := range cases {
+		t.Run(next.String(), func(t *testing.T) {
+			m := &Manager{name: "test"}
+			m.transition(StateConfigured, nil)
+			m.transition(StateCreated, nil)
+			m.transition(StateFailed, errors.New("start failed"))
+
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("Failed -> %s panicked: %v", next, r)
+				}
+			}()
+			m.transition(next, nil)
+		})
+	}
+}
+
+func TestSubscribeReceivesTransitions(t *testing.T) {
+	m := &Manager{name: "test"}
+	events := m.Subscribe()
+
+	m.transition(StateConfigured, nil)
+
+	select {
+	case ev := <-events:
+		if ev.Previous != StateUnknown || ev.Current != StateConfigured {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	default:
+		t.Fatal("expected a state event on the Subscribe channel")
+	}
+}